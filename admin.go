@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// tupleState is one portGroup's current configuration and counters, as
+// surfaced by the admin server's /state and /metrics endpoints.
+type tupleState struct {
+	Instance    string   `json:"instance"`
+	Port        int      `json:"port"`
+	DestPort    int      `json:"dest_port"`
+	Interfaces  []string `json:"interfaces"`
+	Groups4     []string `json:"groups4,omitempty"`
+	Groups6     []string `json:"groups6,omitempty"`
+	PacketsIn   uint64   `json:"packets_in"`
+	BytesIn     uint64   `json:"bytes_in"`
+	PacketsOut  uint64   `json:"packets_out"`
+	BytesOut    uint64   `json:"bytes_out"`
+	RateLimited uint64   `json:"rate_limited"`
+	Deduped     uint64   `json:"deduped"`
+}
+
+// Snapshot returns the current state of every running portGroup across all
+// Forwarders, for /state and /metrics.
+func (m *Manager) Snapshot() []tupleState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []tupleState
+	for _, fwd := range m.forwarders {
+		ifaceNames := make([]string, len(fwd.cfg.Interfaces))
+		copy(ifaceNames, fwd.cfg.Interfaces)
+
+		for _, pg := range fwd.pgs {
+			st := pg.stats.snapshot()
+			ts := tupleState{
+				Instance:    fwd.id,
+				Port:        pg.port,
+				DestPort:    pg.destPort,
+				Interfaces:  ifaceNames,
+				PacketsIn:   st.packetsIn,
+				BytesIn:     st.bytesIn,
+				PacketsOut:  st.packetsOut,
+				BytesOut:    st.bytesOut,
+				RateLimited: st.rateLimited,
+				Deduped:     st.deduped,
+			}
+			for _, g := range pg.groups4 {
+				ts.Groups4 = append(ts.Groups4, g.String())
+			}
+			for _, g := range pg.groups6 {
+				ts.Groups6 = append(ts.Groups6, g.String())
+			}
+			out = append(out, ts)
+		}
+	}
+	return out
+}
+
+// startAdminServer exposes /reload, /state, and /metrics on addr. It runs
+// until the process exits; a failed /reload is answered with HTTP 500 and
+// doesn't crash the server.
+func startAdminServer(addr string, mgr *Manager, configPath string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if configPath == "" {
+			http.Error(w, "no --config file in use", http.StatusBadRequest)
+			return
+		}
+		if err := reloadFromFile(mgr, configPath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "reloaded")
+	})
+
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mgr.Snapshot())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusMetrics(w, mgr.Snapshot())
+	})
+
+	log.Printf("Admin server listening on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Admin server stopped: %v", err)
+		}
+	}()
+}
+
+func writePrometheusMetrics(w http.ResponseWriter, states []tupleState) {
+	metric := func(name, help string, get func(tupleState) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, s := range states {
+			fmt.Fprintf(w, "%s{instance=%q,port=%q} %d\n", name, s.Instance, fmt.Sprint(s.Port), get(s))
+		}
+	}
+
+	metric("ssdp_forwarder_packets_in_total", "Datagrams received per listen port.", func(s tupleState) uint64 { return s.PacketsIn })
+	metric("ssdp_forwarder_bytes_in_total", "Bytes received per listen port.", func(s tupleState) uint64 { return s.BytesIn })
+	metric("ssdp_forwarder_packets_out_total", "Datagrams forwarded per listen port.", func(s tupleState) uint64 { return s.PacketsOut })
+	metric("ssdp_forwarder_rate_limited_total", "Datagrams dropped by --rate per listen port.", func(s tupleState) uint64 { return s.RateLimited })
+	metric("ssdp_forwarder_deduped_total", "Datagrams dropped as duplicates within the dedup window.", func(s tupleState) uint64 { return s.Deduped })
+	metric("ssdp_forwarder_bytes_out_total", "Bytes forwarded per listen port.", func(s tupleState) uint64 { return s.BytesOut })
+}
+
+// logSummaryLoop logs one line every interval summarizing total forwarded
+// traffic and drops across all running instances, for --log-interval.
+func logSummaryLoop(mgr *Manager, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var packetsIn, packetsOut, rateLimited, deduped uint64
+		for _, s := range mgr.Snapshot() {
+			packetsIn += s.PacketsIn
+			packetsOut += s.PacketsOut
+			rateLimited += s.RateLimited
+			deduped += s.Deduped
+		}
+		log.Printf("Summary: in=%d out=%d rate-limited=%d deduped=%d", packetsIn, packetsOut, rateLimited, deduped)
+	}
+}
+
+// reloadFromFile re-reads configPath and applies the diff to mgr. Used by
+// both SIGHUP and the /reload admin endpoint.
+func reloadFromFile(mgr *Manager, configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return mgr.ApplyConfig(cfg)
+}
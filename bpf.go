@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/net/bpf"
+)
+
+// bpfConfig holds the --bpf/--max-packet/--bpf-dump settings, or nil if
+// kernel filtering is disabled.
+type bpfConfig struct {
+	maxPacket int
+	dump      bool
+}
+
+// mdnsGroup is the well-known IPv4 multicast group used for mDNS.
+var mdnsGroup = net.ParseIP("224.0.0.251")
+
+// ssdpPrefixes are the first four bytes of the three HTTPU start lines the
+// forwarder cares about: M-SEARCH requests, NOTIFY announcements, and
+// HTTP/1.1 200 responses to M-SEARCH.
+var ssdpPrefixes = []string{"M-SE", "NOTI", "HTTP"}
+
+// mdnsPrefixes match the first four bytes of a DNS message used over mDNS:
+// a zero transaction ID followed by either the standard query flags (all
+// zero) or the standard authoritative-answer response flags (0x8400).
+var mdnsPrefixes = []string{"\x00\x00\x00\x00", "\x00\x00\x84\x00"}
+
+// udpHeaderLen is the size of the UDP header a SOCK_DGRAM socket filter
+// sees ahead of the payload: SetBPF on a UDP socket (as opposed to a raw
+// AF_PACKET socket) runs the filter over the UDP datagram starting at its
+// 8-byte header, not at the payload. Every payload-relative offset below
+// has to account for that, or the filter ends up comparing against the
+// source/dest port and length/checksum bytes instead of the SSDP/mDNS
+// prefix it's actually looking for.
+const udpHeaderLen = 8
+
+// buildBPFProgram assembles a classic BPF program that, attached to a UDP
+// socket via SetBPF, lets the kernel drop everything except SSDP/mDNS
+// traffic before it is copied to userspace. Offsets are relative to the
+// start of the UDP datagram (header + payload), since that's what a
+// SOCK_DGRAM socket filter sees; prefix checks add udpHeaderLen to land on
+// the payload. The instruction sequence is:
+//
+//  1. (optional) load the packet length extension and return 0 (drop) if
+//     the payload (datagram length minus the UDP header) exceeds
+//     maxPacket, enforcing --max-packet in-kernel.
+//  2. for each candidate prefix, load the first 4 bytes of the payload and
+//     compare against the prefix as a big-endian 32-bit word; a match
+//     jumps straight to the accept instruction, a miss falls through to
+//     the next candidate.
+//  3. if no prefix matched, return 0 (drop); otherwise return 0xFFFF
+//     (accept and deliver the whole frame to userspace).
+func buildBPFProgram(groups []net.IP, maxPacket int) []bpf.Instruction {
+	prefixes := append([]string{}, ssdpPrefixes...)
+	for _, g := range groups {
+		if g.Equal(mdnsGroup) {
+			prefixes = append(prefixes, mdnsPrefixes...)
+			break
+		}
+	}
+
+	var insts []bpf.Instruction
+	if maxPacket > 0 {
+		insts = append(insts,
+			bpf.LoadExtension{Num: bpf.ExtLen},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: uint32(maxPacket) + udpHeaderLen, SkipFalse: 1},
+			bpf.RetConstant{Val: 0},
+		)
+	}
+
+	n := len(prefixes)
+	// acceptIdx is the index, within the final program, of the RetConstant
+	// accept instruction: checkBase + 2*n (load+jumpif per prefix) + 1
+	// (skipping over the reject RetConstant that immediately precedes it).
+	checkBase := len(insts)
+	acceptIdx := checkBase + 2*n + 1
+
+	for i, prefix := range prefixes {
+		curIdx := checkBase + 2*i + 1 // index of this prefix's JumpIf instruction
+		insts = append(insts,
+			bpf.LoadAbsolute{Off: udpHeaderLen, Size: 4},
+			bpf.JumpIf{
+				Cond:     bpf.JumpEqual,
+				Val:      binary.BigEndian.Uint32([]byte(prefix)),
+				SkipTrue: uint8(acceptIdx - curIdx - 1),
+			},
+		)
+	}
+
+	insts = append(insts,
+		bpf.RetConstant{Val: 0},      // reject: no prefix matched
+		bpf.RetConstant{Val: 0xFFFF}, // accept: deliver the whole frame
+	)
+
+	return insts
+}
+
+// applyBPF assembles and attaches a kernel packet filter to pg's sockets so
+// only SSDP/mDNS traffic (and frames within --max-packet) reaches
+// userspace. When dump is true, the assembled program is logged for
+// debugging via --bpf-dump.
+func applyBPF(pg *portGroup, maxPacket int, dump bool) {
+	if pg.pc4 != nil {
+		insts := buildBPFProgram(pg.groups4, maxPacket)
+		if dump {
+			dumpBPFProgram(pg.port, insts)
+		}
+		raw, err := bpf.Assemble(insts)
+		if err != nil {
+			log.Fatalf("Failed to assemble BPF program for port %d: %v", pg.port, err)
+		}
+		if err := pg.pc4.SetBPF(raw); err != nil {
+			log.Fatalf("Failed to attach BPF filter on port %d: %v", pg.port, err)
+		}
+	}
+	// x/net/ipv6.PacketConn exposes no SetBPF equivalent; IPv6 sockets are
+	// left unfiltered.
+}
+
+func dumpBPFProgram(port int, insts []bpf.Instruction) {
+	fmt.Printf("-- BPF program for port %d --\n", port)
+	for i, inst := range insts {
+		fmt.Printf("%3d: %v\n", i, inst)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+)
+
+// fakeDatagram prepends an 8-byte placeholder UDP header to payload, since
+// that's what a SOCK_DGRAM socket filter actually sees ahead of the
+// payload - buildBPFProgram's offsets are relative to this, not to
+// payload[0].
+func fakeDatagram(payload []byte) []byte {
+	return append(make([]byte, udpHeaderLen), payload...)
+}
+
+// runBPF is a tiny classic-BPF interpreter covering exactly the instruction
+// set buildBPFProgram emits (LoadExtension/ExtLen, LoadAbsolute, JumpIf,
+// RetConstant), enough to check accept/reject decisions without a live
+// socket. datagram is the full UDP datagram (header + payload), matching
+// what the kernel filter operates over.
+func runBPF(t *testing.T, insts []bpf.Instruction, datagram []byte) uint32 {
+	t.Helper()
+	pc := 0
+	for {
+		if pc < 0 || pc >= len(insts) {
+			t.Fatalf("program counter %d out of range (len=%d)", pc, len(insts))
+		}
+		switch inst := insts[pc].(type) {
+		case bpf.LoadExtension:
+			if inst.Num != bpf.ExtLen {
+				t.Fatalf("unsupported LoadExtension %v", inst.Num)
+			}
+			pc++ // accumulator value (datagram length) isn't tracked; next JumpIf re-derives it below
+		case bpf.LoadAbsolute:
+			pc++
+		case bpf.JumpIf:
+			// The only two JumpIf uses in buildBPFProgram are the
+			// --max-packet length check (preceded by LoadExtension) and the
+			// 4-byte prefix comparison (preceded by LoadAbsolute). Re-derive
+			// the accumulator from the preceding instruction and datagram.
+			prev := insts[pc-1]
+			var acc uint32
+			switch p := prev.(type) {
+			case bpf.LoadExtension:
+				acc = uint32(len(datagram))
+			case bpf.LoadAbsolute:
+				if p.Size != 4 || int(p.Off)+4 > len(datagram) {
+					acc = 0
+				} else {
+					acc = uint32(datagram[p.Off])<<24 | uint32(datagram[p.Off+1])<<16 |
+						uint32(datagram[p.Off+2])<<8 | uint32(datagram[p.Off+3])
+				}
+			}
+			var match bool
+			switch inst.Cond {
+			case bpf.JumpEqual:
+				match = acc == inst.Val
+			case bpf.JumpGreaterThan:
+				match = acc > inst.Val
+			default:
+				t.Fatalf("unsupported JumpIf condition %v", inst.Cond)
+			}
+			if match {
+				pc += int(inst.SkipTrue) + 1
+			} else {
+				pc += int(inst.SkipFalse) + 1
+			}
+		case bpf.RetConstant:
+			return inst.Val
+		default:
+			t.Fatalf("unsupported instruction %#v", inst)
+		}
+	}
+}
+
+func TestBuildBPFProgramAssembles(t *testing.T) {
+	groups := []net.IP{net.ParseIP("239.255.255.250")}
+	insts := buildBPFProgram(groups, 0)
+	if _, err := bpf.Assemble(insts); err != nil {
+		t.Fatalf("bpf.Assemble() error = %v", err)
+	}
+}
+
+func TestBuildBPFProgramFiltering(t *testing.T) {
+	notify := []byte("NOTIFY * HTTP/1.1\r\n\r\n")
+	msearch := []byte("M-SEARCH * HTTP/1.1\r\n\r\n")
+	httpResp := []byte("HTTP/1.1 200 OK\r\n\r\n")
+	mdnsQuery := []byte("\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00")
+	mdnsResp := []byte("\x00\x00\x84\x00\x00\x00\x00\x01\x00\x00\x00\x00")
+	garbage := []byte("GARBAGE!")
+
+	ssdpGroup := net.ParseIP("239.255.255.250")
+	mdnsGroupIP := net.ParseIP("224.0.0.251")
+
+	tests := []struct {
+		name    string
+		group   net.IP
+		payload []byte
+		want    uint32 // 0 = drop, 0xFFFF = accept
+	}{
+		{"ssdp notify accepted", ssdpGroup, notify, 0xFFFF},
+		{"ssdp msearch accepted", ssdpGroup, msearch, 0xFFFF},
+		{"ssdp http response accepted", ssdpGroup, httpResp, 0xFFFF},
+		{"garbage rejected without mdns group", ssdpGroup, garbage, 0},
+		{"mdns query rejected without mdns group", ssdpGroup, mdnsQuery, 0},
+		{"mdns query accepted with mdns group", mdnsGroupIP, mdnsQuery, 0xFFFF},
+		{"mdns response accepted with mdns group", mdnsGroupIP, mdnsResp, 0xFFFF},
+		{"garbage still rejected with mdns group", mdnsGroupIP, garbage, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			insts := buildBPFProgram([]net.IP{tt.group}, 0)
+			if got := runBPF(t, insts, fakeDatagram(tt.payload)); got != tt.want {
+				t.Errorf("buildBPFProgram() verdict = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildBPFProgramMaxPacket(t *testing.T) {
+	insts := buildBPFProgram(nil, 10)
+	short := []byte("NOTI")
+	long := []byte("NOTIFY * HTTP/1.1 way over the limit\r\n\r\n")
+
+	if got := runBPF(t, insts, fakeDatagram(short)); got != 0xFFFF {
+		t.Errorf("short packet under --max-packet: verdict = %#x, want accept", got)
+	}
+	if got := runBPF(t, insts, fakeDatagram(long)); got != 0 {
+		t.Errorf("long packet over --max-packet: verdict = %#x, want drop", got)
+	}
+}
+
+// TestBuildBPFProgramLiveSocket attaches an assembled program to a real
+// SOCK_DGRAM UDP socket via ipv4.PacketConn.SetBPF and drives datagrams
+// through the actual kernel filter over loopback, rather than the
+// hand-rolled runBPF interpreter above. runBPF only sees the layout
+// fakeDatagram builds (an 8-byte placeholder header ahead of the payload),
+// so it can't confirm that the kernel filter really sees the UDP header
+// there; only a real socket catches an offset that's wrong by udpHeaderLen.
+func TestBuildBPFProgramLiveSocket(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+
+	insts := buildBPFProgram([]net.IP{net.ParseIP("239.255.255.250")}, 0)
+	raw, err := bpf.Assemble(insts)
+	if err != nil {
+		t.Fatalf("bpf.Assemble() error = %v", err)
+	}
+	if err := pc.SetBPF(raw); err != nil {
+		t.Skipf("SetBPF unsupported in this environment: %v", err)
+	}
+
+	sender, err := net.Dial("udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer sender.Close()
+
+	if _, err := sender.Write([]byte("GARBAGE!")); err != nil {
+		t.Fatalf("Write(garbage) error = %v", err)
+	}
+	if _, err := sender.Write([]byte("NOTIFY * HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf("Write(notify) error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected the NOTIFY datagram to pass the kernel filter, got error: %v", err)
+	}
+	if got := string(buf[:n]); got != "NOTIFY * HTTP/1.1\r\n\r\n" {
+		t.Fatalf("accepted datagram = %q, want the NOTIFY payload (garbage should have been dropped in-kernel)", got)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf); err == nil {
+		t.Fatal("a second datagram was delivered; want only the NOTIFY one (garbage should be dropped in-kernel)")
+	}
+}
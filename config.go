@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InstanceConfig describes one independent forwarding topology: a set of
+// interfaces bridging a set of multicast groups on a set of ports. A config
+// file lists one or more of these under "instances"; each becomes its own
+// Forwarder so they can be reloaded independently on SIGHUP.
+type InstanceConfig struct {
+	ID          string   `yaml:"id"`
+	Interfaces  []string `yaml:"interfaces"`
+	Groups      []string `yaml:"groups"`
+	Ports       []int    `yaml:"ports"`
+	DestPorts   []int    `yaml:"dest_ports,omitempty"`
+	Verbose     bool     `yaml:"verbose,omitempty"`
+	SSDPRewrite bool     `yaml:"ssdp_rewrite,omitempty"`
+}
+
+// FileConfig is the top-level shape of a --config YAML document.
+type FileConfig struct {
+	Instances []InstanceConfig `yaml:"instances"`
+}
+
+// loadConfig reads and validates a --config YAML document.
+func loadConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+
+	var cfg FileConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool, len(cfg.Instances))
+	for i := range cfg.Instances {
+		inst := &cfg.Instances[i]
+		if inst.ID == "" {
+			return nil, fmt.Errorf("instance %d: missing id", i)
+		}
+		if seen[inst.ID] {
+			return nil, fmt.Errorf("duplicate instance id %q", inst.ID)
+		}
+		seen[inst.ID] = true
+
+		if len(inst.Interfaces) == 0 {
+			return nil, fmt.Errorf("instance %q: no interfaces", inst.ID)
+		}
+		if len(inst.Groups) == 0 {
+			return nil, fmt.Errorf("instance %q: no groups", inst.ID)
+		}
+		if len(inst.Ports) == 0 {
+			return nil, fmt.Errorf("instance %q: no ports", inst.ID)
+		}
+		if len(inst.DestPorts) == 0 {
+			inst.DestPorts = inst.Ports
+		} else if len(inst.DestPorts) != len(inst.Ports) {
+			return nil, fmt.Errorf("instance %q: dest_ports (%d) must match ports (%d)",
+				inst.ID, len(inst.DestPorts), len(inst.Ports))
+		}
+	}
+
+	return &cfg, nil
+}
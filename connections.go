@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// portGroup describes everything the forwarder needs to know about a single
+// listen port: the interfaces it serves, the multicast groups joined on
+// that port (split by address family), and the sockets used to read and
+// write datagrams.
+type portGroup struct {
+	instanceID string
+	port       int
+	destPort   int
+
+	ifaces    []*net.Interface
+	localIPv4 map[int]net.IP // ifIndex -> first IPv4 address on that interface
+	localIPv6 map[int]net.IP // ifIndex -> first IPv6 address on that interface
+
+	groups4 []net.IP
+	groups6 []net.IP
+
+	pc4 *ipv4.PacketConn
+	pc6 *ipv6.PacketConn
+
+	rateLimiter *egressLimiter // nil disables rate limiting
+	dedup       *dedupCache    // nil disables dedup suppression
+
+	stats portStats
+
+	cancel context.CancelFunc // stops this portGroup's forwarding goroutines only
+	wg     sync.WaitGroup     // tracks this portGroup's forwarding goroutines only
+}
+
+// firstIPv6Addr returns the first IPv6 address found on the given
+// interface, link-local addresses included, or an error if none is present.
+func firstIPv6Addr(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.To4() != nil {
+			continue
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no IPv6 address found on interface %s", ifi.Name)
+}
+
+// initializeConnections binds one wildcard UDP socket per listen port
+// (shared across every group and interface on that port) and joins it to
+// every (interface, group) pair in the instance's configuration. It returns
+// one *portGroup per port, replacing the old [group][iface][port] socket
+// matrix: interfaces and groups now share a single socket per port, so the
+// number of open file descriptors scales with len(ports) rather than
+// len(groups)*len(ifaces)*len(ports).
+func initializeConnections(instanceID string, groups, ifaceNames []string, ports, destPorts []int, bpfCfg *bpfConfig) []*portGroup {
+	ifaces := make([]*net.Interface, 0, len(ifaceNames))
+	for _, name := range ifaceNames {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Fatalf("Could not find interface %q: %v", name, err)
+		}
+		ifaces = append(ifaces, ifi)
+	}
+
+	var groups4, groups6 []net.IP
+	for _, g := range groups {
+		ip := net.ParseIP(g)
+		if ip == nil {
+			log.Fatalf("Failed to parse multicast group %q", g)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			groups4 = append(groups4, ip4)
+		} else {
+			groups6 = append(groups6, ip)
+		}
+	}
+
+	pgs := make([]*portGroup, 0, len(ports))
+	for idx, port := range ports {
+		pgs = append(pgs, initializePortGroup(instanceID, ifaces, groups4, groups6, port, destPorts[idx], bpfCfg))
+	}
+
+	return pgs
+}
+
+// initializePortGroup binds and joins a single port's sockets. It is the
+// per-port body of initializeConnections, factored out so an incremental
+// topology change (e.g. a new port added on SIGHUP) can bring up one more
+// portGroup without touching any other port's sockets.
+func initializePortGroup(instanceID string, ifaces []*net.Interface, groups4, groups6 []net.IP, port, destPort int, bpfCfg *bpfConfig) *portGroup {
+	pg := &portGroup{
+		instanceID: instanceID,
+		port:       port,
+		destPort:   destPort,
+		ifaces:     ifaces,
+		localIPv4:  make(map[int]net.IP),
+		localIPv6:  make(map[int]net.IP),
+		groups4:    groups4,
+		groups6:    groups6,
+	}
+
+	for _, ifi := range ifaces {
+		if ip, err := firstIPv4Addr(ifi); err == nil {
+			pg.localIPv4[ifi.Index] = net.ParseIP(ip)
+		}
+		if ip, err := firstIPv6Addr(ifi); err == nil {
+			pg.localIPv6[ifi.Index] = ip
+		}
+	}
+
+	if len(groups4) > 0 {
+		pg.pc4 = listenIPv4(port, ifaces, groups4)
+		if bpfCfg != nil {
+			applyBPF(pg, bpfCfg.maxPacket, bpfCfg.dump)
+		}
+	}
+	if len(groups6) > 0 {
+		pg.pc6 = listenIPv6(port, ifaces, groups6)
+	}
+
+	for _, ifi := range ifaces {
+		log.Printf("Listening on port=%d, iface=%s, groups=%v/%v (forwarding to port %d)",
+			port, ifi.Name, groups4, groups6, pg.destPort)
+	}
+
+	return pg
+}
+
+// reusePortListenConfig returns a net.ListenConfig whose Control callback
+// sets SO_REUSEADDR and SO_REUSEPORT on the raw socket before it's bound, so
+// multiple instances (or a restarting one) can bind the same wildcard
+// port:group without "address already in use".
+func reusePortListenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// listenIPv4 binds a wildcard IPv4 UDP socket on port with SO_REUSEADDR and
+// SO_REUSEPORT set via reusePortListenConfig, and joins every (interface,
+// group) pair so a single socket can receive datagrams for all of them.
+func listenIPv4(port int, ifaces []*net.Interface, groups []net.IP) *ipv4.PacketConn {
+	lc := reusePortListenConfig()
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Failed to bind IPv4 wildcard socket on port %d: %v", port, err)
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		udpConn.SetReadBuffer(BufferLen)
+	}
+	pc := ipv4.NewPacketConn(conn)
+
+	for _, ifi := range ifaces {
+		for _, group := range groups {
+			if err := pc.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+				log.Fatalf("Failed to join group=%s on iface=%s, port=%d: %v", group, ifi.Name, port, err)
+			}
+		}
+	}
+
+	if err := pc.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst|ipv4.FlagTTL, true); err != nil {
+		log.Fatalf("Failed to enable IPv4 control messages on port %d: %v", port, err)
+	}
+
+	return pc
+}
+
+// listenIPv6 is the IPv6 analogue of listenIPv4, used for SSDP/mDNS groups
+// such as ff02::c or ff02::fb.
+func listenIPv6(port int, ifaces []*net.Interface, groups []net.IP) *ipv6.PacketConn {
+	lc := reusePortListenConfig()
+	conn, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Failed to bind IPv6 wildcard socket on port %d: %v", port, err)
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		udpConn.SetReadBuffer(BufferLen)
+	}
+	pc := ipv6.NewPacketConn(conn)
+
+	for _, ifi := range ifaces {
+		for _, group := range groups {
+			if err := pc.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+				log.Fatalf("Failed to join group=%s on iface=%s, port=%d: %v", group, ifi.Name, port, err)
+			}
+		}
+	}
+
+	if err := pc.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst|ipv6.FlagHopLimit, true); err != nil {
+		log.Fatalf("Failed to enable IPv6 control messages on port %d: %v", port, err)
+	}
+
+	return pc
+}
+
+// closeConnections closes every socket opened by initializeConnections.
+func closeConnections(pgs []*portGroup) {
+	for _, pg := range pgs {
+		closeConnection(pg)
+	}
+}
+
+// closeConnection closes the sockets owned by a single portGroup, used both
+// by closeConnections and by an incremental reload removing one port.
+func closeConnection(pg *portGroup) {
+	if pg.pc4 != nil {
+		pg.pc4.Close()
+	}
+	if pg.pc6 != nil {
+		pg.pc6.Close()
+	}
+}
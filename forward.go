@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// startForwarding launches one read-loop goroutine per address family per
+// port. Each loop reads from the shared *ipv4.PacketConn/*ipv6.PacketConn,
+// uses the control message attached to the datagram to identify the
+// arrival interface and destination group, and relays a copy out every
+// other interface pinned via a control message on the send side rather
+// than a pre-dialed per-interface socket.
+func startForwarding(ctx context.Context, pgs []*portGroup, verbose bool, rewriter *ssdpRewriter) {
+	for _, pg := range pgs {
+		startPortGroup(ctx, pg, verbose, rewriter)
+	}
+}
+
+// startPortGroup launches pg's own read-loop goroutines under a context
+// derived from parent, tracked by pg's own cancel/wg rather than a
+// Forwarder-wide one - so stopPortGroup can stop this one port without
+// touching any other portGroup.
+func startPortGroup(parent context.Context, pg *portGroup, verbose bool, rewriter *ssdpRewriter) {
+	ctx, cancel := context.WithCancel(parent)
+	pg.cancel = cancel
+	if pg.pc4 != nil {
+		pg.wg.Add(1)
+		go forwardIPv4(ctx, &pg.wg, pg, verbose, rewriter)
+	}
+	if pg.pc6 != nil {
+		pg.wg.Add(1)
+		go forwardIPv6(ctx, &pg.wg, pg, verbose, rewriter)
+	}
+}
+
+// stopPortGroup cancels pg's forwarding goroutines, waits for them to
+// exit, closes its sockets, and stops its dedup reaper goroutine - used to
+// drop a single removed port during an incremental reload without
+// affecting any other portGroup.
+func stopPortGroup(pg *portGroup) {
+	if pg.cancel != nil {
+		pg.cancel()
+	}
+	pg.wg.Wait()
+	closeConnection(pg)
+	if pg.dedup != nil {
+		pg.dedup.Close()
+	}
+}
+
+func forwardIPv4(ctx context.Context, wg *sync.WaitGroup, pg *portGroup, verbose bool, rewriter *ssdpRewriter) {
+	defer wg.Done()
+	buf := make([]byte, BufferLen)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if verbose {
+				log.Printf("IPv4 goroutine for port=%d exiting.", pg.port)
+			}
+			return
+		default:
+		}
+
+		pg.pc4.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, cm, src, err := pg.pc4.ReadFrom(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			log.Printf("Read error on port=%d (v4): %v", pg.port, err)
+			return
+		}
+		if cm == nil {
+			continue
+		}
+
+		srcUDP, _ := src.(*net.UDPAddr)
+		if srcUDP == nil || isLocalAddr(pg, srcUDP.IP) {
+			continue // hairpinned datagram we sent ourselves
+		}
+		if isExpiredHopCount(cm.TTL) {
+			continue // true loop prevention: only our own joins see TTL 1
+		}
+
+		pg.stats.addIn(n)
+
+		if pg.dedup != nil && pg.dedup.Seen(srcUDP.IP, pg.port, buf[:n]) {
+			pg.stats.addDeduped()
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		for _, outIf := range pg.ifaces {
+			if outIf.Index == cm.IfIndex {
+				continue // don't send back on the interface it arrived on
+			}
+			if pg.rateLimiter != nil && !pg.rateLimiter.Allow(outIf.Index, cm.Dst, pg.destPort) {
+				pg.stats.addRateLimited()
+				continue
+			}
+			outPacket, ok := applySSDPRewrite(rewriter, packet, pg.localIPv4[outIf.Index], pg.destPort)
+			if !ok {
+				continue // loop detected by X-Forwarded-By
+			}
+			outCM := &ipv4.ControlMessage{IfIndex: outIf.Index}
+			if _, werr := pg.pc4.WriteTo(outPacket, outCM, &net.UDPAddr{IP: cm.Dst, Port: pg.destPort}); werr != nil {
+				log.Printf("Forward error: port=%d, to iface=%s: %v", pg.port, outIf.Name, werr)
+			} else {
+				pg.stats.addOut(len(outPacket))
+				if verbose {
+					log.Printf("Forwarded %d bytes from %v to iface=%s:%d (group=%s)",
+						n, src, outIf.Name, pg.destPort, cm.Dst)
+				}
+			}
+		}
+	}
+}
+
+func forwardIPv6(ctx context.Context, wg *sync.WaitGroup, pg *portGroup, verbose bool, rewriter *ssdpRewriter) {
+	defer wg.Done()
+	buf := make([]byte, BufferLen)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if verbose {
+				log.Printf("IPv6 goroutine for port=%d exiting.", pg.port)
+			}
+			return
+		default:
+		}
+
+		pg.pc6.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, cm, src, err := pg.pc6.ReadFrom(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			log.Printf("Read error on port=%d (v6): %v", pg.port, err)
+			return
+		}
+		if cm == nil {
+			continue
+		}
+
+		srcUDP, _ := src.(*net.UDPAddr)
+		if srcUDP == nil || isLocalAddr(pg, srcUDP.IP) {
+			continue
+		}
+		if isExpiredHopCount(cm.HopLimit) {
+			continue
+		}
+
+		pg.stats.addIn(n)
+
+		if pg.dedup != nil && pg.dedup.Seen(srcUDP.IP, pg.port, buf[:n]) {
+			pg.stats.addDeduped()
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		for _, outIf := range pg.ifaces {
+			if outIf.Index == cm.IfIndex {
+				continue
+			}
+			if pg.rateLimiter != nil && !pg.rateLimiter.Allow(outIf.Index, cm.Dst, pg.destPort) {
+				pg.stats.addRateLimited()
+				continue
+			}
+			outPacket, ok := applySSDPRewrite(rewriter, packet, pg.localIPv6[outIf.Index], pg.destPort)
+			if !ok {
+				continue // loop detected by X-Forwarded-By
+			}
+			outCM := &ipv6.ControlMessage{IfIndex: outIf.Index}
+			if _, werr := pg.pc6.WriteTo(outPacket, outCM, &net.UDPAddr{IP: cm.Dst, Port: pg.destPort}); werr != nil {
+				log.Printf("Forward error: port=%d, to iface=%s: %v", pg.port, outIf.Name, werr)
+			} else {
+				pg.stats.addOut(len(outPacket))
+				if verbose {
+					log.Printf("Forwarded %d bytes from %v to iface=%s:%d (group=%s)",
+						n, src, outIf.Name, pg.destPort, cm.Dst)
+				}
+			}
+		}
+	}
+}
+
+// isExpiredHopCount reports whether ttl (the IPv4 TTL or IPv6 hop limit on
+// an arriving datagram) indicates a packet we joined ourselves relaying it
+// back to us, rather than genuine traffic routed from a remote source: a
+// multicast datagram we sent and that looped back over a joined interface
+// arrives with exactly one hop remaining.
+func isExpiredHopCount(ttl int) bool {
+	return ttl == 1
+}
+
+// isLocalAddr reports whether ip matches one of our own interface
+// addresses, meaning the datagram is a hairpinned copy of one we forwarded
+// ourselves rather than traffic from a genuine remote source.
+func isLocalAddr(pg *portGroup, ip net.IP) bool {
+	for _, local := range pg.localIPv4 {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	for _, local := range pg.localIPv6 {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
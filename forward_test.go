@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsExpiredHopCount(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  int
+		want bool
+	}{
+		{"expired", 1, true},
+		{"fresh", 64, false},
+		{"zero", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isExpiredHopCount(tt.ttl); got != tt.want {
+				t.Errorf("isExpiredHopCount(%d) = %v, want %v", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	pg := &portGroup{
+		localIPv4: map[int]net.IP{1: net.ParseIP("192.168.1.5")},
+		localIPv6: map[int]net.IP{1: net.ParseIP("fe80::1")},
+	}
+
+	tests := []struct {
+		name string
+		ip   net.IP
+		want bool
+	}{
+		{"matches local ipv4", net.ParseIP("192.168.1.5"), true},
+		{"matches local ipv6", net.ParseIP("fe80::1"), true},
+		{"remote ipv4", net.ParseIP("192.168.1.100"), false},
+		{"remote ipv6", net.ParseIP("fe80::2"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocalAddr(pg, tt.ip); got != tt.want {
+				t.Errorf("isLocalAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
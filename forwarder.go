@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// shapingConfig bundles the --rate and --dedup-window settings applied
+// uniformly to every portGroup a Forwarder owns.
+type shapingConfig struct {
+	rate        *rateLimitConfig
+	dedupWindow time.Duration
+}
+
+// Forwarder runs one InstanceConfig's worth of forwarding goroutines. It is
+// the unit Start/Stop operates on, so the admin server and SIGHUP reload
+// can bring instances up and down independently of one another.
+//
+// Each portGroup cancels and waits on its own goroutines (see
+// portGroup.cancel/wg) rather than sharing a single Forwarder-wide
+// WaitGroup, so a reload can stop or start one port without touching any
+// other port's sockets or goroutines.
+type Forwarder struct {
+	id       string
+	cfg      InstanceConfig
+	bpfCfg   *bpfConfig
+	shaping  shapingConfig
+	limiter  *egressLimiter // shared across every portGroup, nil if --rate is unset
+	pgs      []*portGroup
+	rewriter *ssdpRewriter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewForwarder builds the sockets for cfg but does not start forwarding
+// goroutines yet; call Start for that.
+func NewForwarder(cfg InstanceConfig, bpfCfg *bpfConfig, shaping shapingConfig) *Forwarder {
+	pgs := initializeConnections(cfg.ID, cfg.Groups, cfg.Interfaces, cfg.Ports, cfg.DestPorts, bpfCfg)
+
+	var limiter *egressLimiter
+	if shaping.rate != nil {
+		limiter = newEgressLimiter(*shaping.rate)
+	}
+	for _, pg := range pgs {
+		pg.rateLimiter = limiter
+		if shaping.dedupWindow > 0 {
+			pg.dedup = newDedupCache(shaping.dedupWindow)
+		}
+	}
+
+	var rewriter *ssdpRewriter
+	if cfg.SSDPRewrite {
+		rewriter = newSSDPRewriter()
+	}
+
+	return &Forwarder{id: cfg.ID, cfg: cfg, bpfCfg: bpfCfg, shaping: shaping, limiter: limiter, pgs: pgs, rewriter: rewriter}
+}
+
+// wireShaping applies the Forwarder's shared rate limiter and a fresh dedup
+// cache (if configured) to a newly created portGroup, the same way
+// NewForwarder wires up the initial set - used when a reload brings up one
+// more port incrementally.
+func (f *Forwarder) wireShaping(pg *portGroup) {
+	pg.rateLimiter = f.limiter
+	if f.shaping.dedupWindow > 0 {
+		pg.dedup = newDedupCache(f.shaping.dedupWindow)
+	}
+}
+
+// Start launches the per-port forwarding goroutines. It must only be
+// called once per Forwarder.
+func (f *Forwarder) Start(ctx context.Context) {
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	startForwarding(f.ctx, f.pgs, f.cfg.Verbose, f.rewriter)
+}
+
+// Stop cancels every portGroup's forwarding goroutines, waits for them to
+// exit, closes the underlying sockets, and stops any dedup/rewriter reaper
+// goroutines so a Forwarder torn down by a reload leaves nothing running
+// behind it. Existing unrelated Forwarders are unaffected.
+func (f *Forwarder) Stop() {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	for _, pg := range f.pgs {
+		pg.wg.Wait()
+	}
+	closeConnections(f.pgs)
+	for _, pg := range f.pgs {
+		if pg.dedup != nil {
+			pg.dedup.Close()
+		}
+	}
+	if f.rewriter != nil {
+		f.rewriter.Close()
+	}
+}
+
+// updateGroups incrementally joins/leaves the multicast groups that
+// differ between the running instance and newGroups, without closing or
+// reopening any socket - so unrelated, unchanged groups keep flowing
+// without a dropped packet.
+func (f *Forwarder) updateGroups(newGroups []string) error {
+	newGroups4, newGroups6, err := splitGroups(newGroups)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", f.id, err)
+	}
+
+	for _, pg := range f.pgs {
+		if err := updateGroupsForPG(pg, newGroups4, newGroups6); err != nil {
+			return fmt.Errorf("instance %q: %w", f.id, err)
+		}
+	}
+
+	f.cfg.Groups = newGroups
+	return nil
+}
+
+// splitGroups parses a config's Groups list into its IPv4 and IPv6 members.
+func splitGroups(groups []string) (groups4, groups6 []net.IP, err error) {
+	for _, g := range groups {
+		ip := net.ParseIP(g)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid group %q", g)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			groups4 = append(groups4, ip4)
+		} else {
+			groups6 = append(groups6, ip)
+		}
+	}
+	return groups4, groups6, nil
+}
+
+// updateGroupsForPG joins/leaves the multicast groups that differ between
+// pg's current membership and newGroups4/newGroups6 on every interface pg
+// already serves, and records the new membership on pg.
+func updateGroupsForPG(pg *portGroup, newGroups4, newGroups6 []net.IP) error {
+	if pg.pc4 != nil {
+		added, removed := diffGroups(pg.groups4, newGroups4)
+		for _, ifi := range pg.ifaces {
+			for _, g := range added {
+				if err := pg.pc4.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+					return fmt.Errorf("port %d: join %s on %s: %w", pg.port, g, ifi.Name, err)
+				}
+			}
+			for _, g := range removed {
+				if err := pg.pc4.LeaveGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+					log.Printf("port %d: leave %s on %s: %v", pg.port, g, ifi.Name, err)
+				}
+			}
+		}
+		pg.groups4 = newGroups4
+	}
+	if pg.pc6 != nil {
+		added, removed := diffGroups(pg.groups6, newGroups6)
+		for _, ifi := range pg.ifaces {
+			for _, g := range added {
+				if err := pg.pc6.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+					return fmt.Errorf("port %d: join %s on %s: %w", pg.port, g, ifi.Name, err)
+				}
+			}
+			for _, g := range removed {
+				if err := pg.pc6.LeaveGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+					log.Printf("port %d: leave %s on %s: %v", pg.port, g, ifi.Name, err)
+				}
+			}
+		}
+		pg.groups6 = newGroups6
+	}
+	return nil
+}
+
+// diffGroups returns the groups present in "next" but not "cur" (to join)
+// and the groups present in "cur" but not "next" (to leave).
+func diffGroups(cur, next []net.IP) (added, removed []net.IP) {
+	for _, n := range next {
+		found := false
+		for _, c := range cur {
+			if c.Equal(n) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, n)
+		}
+	}
+	for _, c := range cur {
+		found := false
+		for _, n := range next {
+			if c.Equal(n) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
+
+// diffStrings returns the entries present in "next" but not "cur" (added)
+// and the entries present in "cur" but not "next" (removed).
+func diffStrings(cur, next []string) (added, removed []string) {
+	for _, n := range next {
+		found := false
+		for _, c := range cur {
+			if c == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, n)
+		}
+	}
+	for _, c := range cur {
+		found := false
+		for _, n := range next {
+			if c == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, c)
+		}
+	}
+	return added, removed
+}
+
+// resolveInterfaces looks up each interface name, as net.InterfaceByName.
+func resolveInterfaces(names []string) ([]*net.Interface, error) {
+	ifaces := make([]*net.Interface, 0, len(names))
+	for _, name := range names {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+		ifaces = append(ifaces, ifi)
+	}
+	return ifaces, nil
+}
+
+// removeInterface returns ifaces with target removed, by index.
+func removeInterface(ifaces []*net.Interface, target *net.Interface) []*net.Interface {
+	out := ifaces[:0]
+	for _, ifi := range ifaces {
+		if ifi.Index != target.Index {
+			out = append(out, ifi)
+		}
+	}
+	return out
+}
+
+// applyTopologyDiff incrementally reconciles f with newCfg when Interfaces,
+// Ports, DestPorts, and/or Groups changed but Verbose/SSDPRewrite did not
+// (guaranteed by the caller, onlyTopologyChanged): interfaces are
+// joined/left on every port that's staying, ports are added or removed as
+// whole portGroups, and groups are diffed via updateGroupsForPG. No
+// unrelated, already-running socket is closed or restarted, so e.g. adding
+// a VLAN interface to a bridging instance doesn't drop a single packet on
+// that instance's other groups or ports.
+func (f *Forwarder) applyTopologyDiff(newCfg InstanceConfig) error {
+	newGroups4, newGroups6, err := splitGroups(newCfg.Groups)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", f.id, err)
+	}
+
+	oldDestPort := make(map[int]int, len(f.cfg.Ports))
+	for i, p := range f.cfg.Ports {
+		oldDestPort[p] = f.cfg.DestPorts[i]
+	}
+	newDestPort := make(map[int]int, len(newCfg.Ports))
+	for i, p := range newCfg.Ports {
+		newDestPort[p] = newCfg.DestPorts[i]
+	}
+
+	addedIfaceNames, removedIfaceNames := diffStrings(f.cfg.Interfaces, newCfg.Interfaces)
+	addedIfaces, err := resolveInterfaces(addedIfaceNames)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", f.id, err)
+	}
+	removedIfaces, err := resolveInterfaces(removedIfaceNames)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", f.id, err)
+	}
+
+	// Drop ports that no longer exist, or whose dest port changed - that
+	// needs a fresh socket bind, but only for that one port.
+	var kept []*portGroup
+	for _, pg := range f.pgs {
+		if destPort, ok := newDestPort[pg.port]; ok && destPort == pg.destPort {
+			kept = append(kept, pg)
+			continue
+		}
+		log.Printf("instance %q: stopping removed port=%d", f.id, pg.port)
+		stopPortGroup(pg)
+	}
+	f.pgs = kept
+
+	// Join/leave interfaces and groups on every port that's staying.
+	for _, pg := range f.pgs {
+		for _, ifi := range removedIfaces {
+			if pg.pc4 != nil {
+				for _, g := range pg.groups4 {
+					if err := pg.pc4.LeaveGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+						log.Printf("instance %q: port %d: leave %s on %s: %v", f.id, pg.port, g, ifi.Name, err)
+					}
+				}
+			}
+			if pg.pc6 != nil {
+				for _, g := range pg.groups6 {
+					if err := pg.pc6.LeaveGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+						log.Printf("instance %q: port %d: leave %s on %s: %v", f.id, pg.port, g, ifi.Name, err)
+					}
+				}
+			}
+			pg.ifaces = removeInterface(pg.ifaces, ifi)
+			delete(pg.localIPv4, ifi.Index)
+			delete(pg.localIPv6, ifi.Index)
+		}
+
+		if err := updateGroupsForPG(pg, newGroups4, newGroups6); err != nil {
+			return fmt.Errorf("instance %q: %w", f.id, err)
+		}
+
+		for _, ifi := range addedIfaces {
+			pg.ifaces = append(pg.ifaces, ifi)
+			if ip, err := firstIPv4Addr(ifi); err == nil {
+				pg.localIPv4[ifi.Index] = net.ParseIP(ip)
+			}
+			if ip, err := firstIPv6Addr(ifi); err == nil {
+				pg.localIPv6[ifi.Index] = ip
+			}
+			if pg.pc4 != nil {
+				for _, g := range pg.groups4 {
+					if err := pg.pc4.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+						return fmt.Errorf("instance %q: port %d: join %s on %s: %w", f.id, pg.port, g, ifi.Name, err)
+					}
+				}
+			}
+			if pg.pc6 != nil {
+				for _, g := range pg.groups6 {
+					if err := pg.pc6.JoinGroup(ifi, &net.UDPAddr{IP: g}); err != nil {
+						return fmt.Errorf("instance %q: port %d: join %s on %s: %w", f.id, pg.port, g, ifi.Name, err)
+					}
+				}
+			}
+		}
+	}
+
+	// Bring up any genuinely new ports (or ports whose dest port changed)
+	// with the full, final interface and group set.
+	finalIfaces, err := resolveInterfaces(newCfg.Interfaces)
+	if err != nil {
+		return fmt.Errorf("instance %q: %w", f.id, err)
+	}
+	for i, port := range newCfg.Ports {
+		destPort := newCfg.DestPorts[i]
+		if old, ok := oldDestPort[port]; ok && old == destPort {
+			continue // already kept above
+		}
+		log.Printf("instance %q: starting new port=%d", f.id, port)
+		pg := initializePortGroup(f.id, finalIfaces, newGroups4, newGroups6, port, destPort, f.bpfCfg)
+		f.wireShaping(pg)
+		startPortGroup(f.ctx, pg, newCfg.Verbose, f.rewriter)
+		f.pgs = append(f.pgs, pg)
+	}
+
+	f.cfg = newCfg
+	return nil
+}
+
+// Manager owns the set of running Forwarders and implements hot reload: it
+// diffs a freshly-loaded FileConfig against what's currently running and
+// applies only the changes needed, restarting an instance wholesale only
+// when its verbose or ssdp_rewrite setting changed.
+type Manager struct {
+	mu         sync.Mutex
+	ctx        context.Context
+	bpfCfg     *bpfConfig
+	shaping    shapingConfig
+	forwarders map[string]*Forwarder
+}
+
+func NewManager(ctx context.Context, bpfCfg *bpfConfig, shaping shapingConfig) *Manager {
+	return &Manager{ctx: ctx, bpfCfg: bpfCfg, shaping: shaping, forwarders: make(map[string]*Forwarder)}
+}
+
+// ApplyConfig starts, stops, or incrementally updates Forwarders so the
+// running set matches cfg. It is used both for the initial startup and for
+// every subsequent reload.
+func (m *Manager) ApplyConfig(cfg *FileConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	desired := make(map[string]InstanceConfig, len(cfg.Instances))
+	for _, inst := range cfg.Instances {
+		desired[inst.ID] = inst
+	}
+
+	for id, fwd := range m.forwarders {
+		if _, ok := desired[id]; !ok {
+			log.Printf("Stopping removed instance %q", id)
+			fwd.Stop()
+			delete(m.forwarders, id)
+		}
+	}
+
+	for id, newCfg := range desired {
+		old, running := m.forwarders[id]
+		switch {
+		case !running:
+			log.Printf("Starting new instance %q", id)
+			fwd := NewForwarder(newCfg, m.bpfCfg, m.shaping)
+			fwd.Start(m.ctx)
+			m.forwarders[id] = fwd
+
+		case reflect.DeepEqual(old.cfg, newCfg):
+			// unchanged
+
+		case onlyGroupsChanged(old.cfg, newCfg):
+			log.Printf("Updating groups for instance %q", id)
+			if err := old.updateGroups(newCfg.Groups); err != nil {
+				return err
+			}
+
+		case onlyTopologyChanged(old.cfg, newCfg):
+			log.Printf("Updating topology for instance %q", id)
+			if err := old.applyTopologyDiff(newCfg); err != nil {
+				return err
+			}
+
+		default:
+			log.Printf("Restarting instance %q (verbose/ssdp-rewrite changed)", id)
+			old.Stop()
+			fwd := NewForwarder(newCfg, m.bpfCfg, m.shaping)
+			fwd.Start(m.ctx)
+			m.forwarders[id] = fwd
+		}
+	}
+
+	return nil
+}
+
+// onlyGroupsChanged reports whether a and b only differ in which multicast
+// groups are joined, so the change can be applied via JoinGroup/LeaveGroup
+// instead of tearing down sockets.
+func onlyGroupsChanged(a, b InstanceConfig) bool {
+	return reflect.DeepEqual(a.Interfaces, b.Interfaces) &&
+		reflect.DeepEqual(a.Ports, b.Ports) &&
+		reflect.DeepEqual(a.DestPorts, b.DestPorts) &&
+		a.Verbose == b.Verbose &&
+		a.SSDPRewrite == b.SSDPRewrite
+}
+
+// onlyTopologyChanged reports whether a and b differ only in Interfaces,
+// Ports, DestPorts, and/or Groups - i.e. Verbose and SSDPRewrite, which
+// affect every packet on every port, are unchanged. Such a change can be
+// applied incrementally via applyTopologyDiff: unrelated ports, interfaces,
+// and groups keep running untouched.
+func onlyTopologyChanged(a, b InstanceConfig) bool {
+	return a.Verbose == b.Verbose && a.SSDPRewrite == b.SSDPRewrite
+}
+
+// StopAll stops every running Forwarder, used on final shutdown.
+func (m *Manager) StopAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, fwd := range m.forwarders {
+		fwd.Stop()
+		delete(m.forwarders, id)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func mustIPs(t *testing.T, addrs ...string) []net.IP {
+	t.Helper()
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			t.Fatalf("invalid test IP %q", a)
+		}
+		ips[i] = ip
+	}
+	return ips
+}
+
+func TestDiffGroups(t *testing.T) {
+	tests := []struct {
+		name        string
+		cur, next   []net.IP
+		wantAdded   []net.IP
+		wantRemoved []net.IP
+	}{
+		{"no change", mustIPs(t, "239.255.255.250"), mustIPs(t, "239.255.255.250"), nil, nil},
+		{"add one", mustIPs(t, "239.255.255.250"), mustIPs(t, "239.255.255.250", "224.0.0.251"), mustIPs(t, "224.0.0.251"), nil},
+		{"remove one", mustIPs(t, "239.255.255.250", "224.0.0.251"), mustIPs(t, "239.255.255.250"), nil, mustIPs(t, "224.0.0.251")},
+		{"replace", mustIPs(t, "239.255.255.250"), mustIPs(t, "224.0.0.251"), mustIPs(t, "224.0.0.251"), mustIPs(t, "239.255.255.250")},
+		{"empty to empty", nil, nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffGroups(tt.cur, tt.next)
+			if !ipsEqual(added, tt.wantAdded) {
+				t.Errorf("added = %v, want %v", added, tt.wantAdded)
+			}
+			if !ipsEqual(removed, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func ipsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOnlyGroupsChanged(t *testing.T) {
+	base := InstanceConfig{
+		ID:         "default",
+		Interfaces: []string{"eth0"},
+		Ports:      []int{1900},
+		DestPorts:  []int{1900},
+		Groups:     []string{"239.255.255.250"},
+	}
+
+	tests := []struct {
+		name string
+		b    InstanceConfig
+		want bool
+	}{
+		{"groups only", withGroups(base, "224.0.0.251"), true},
+		{"identical", base, true},
+		{"interfaces differ", withInterfaces(base, "eth1"), false},
+		{"ports differ", withPorts(base, 1901), false},
+		{"dest ports differ", withDestPorts(base, 1901), false},
+		{"verbose differs", withVerbose(base, true), false},
+		{"ssdp-rewrite differs", withSSDPRewrite(base, true), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onlyGroupsChanged(base, tt.b); got != tt.want {
+				t.Errorf("onlyGroupsChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnlyTopologyChanged(t *testing.T) {
+	base := InstanceConfig{
+		ID:         "default",
+		Interfaces: []string{"eth0"},
+		Ports:      []int{1900},
+		DestPorts:  []int{1900},
+		Groups:     []string{"239.255.255.250"},
+	}
+
+	tests := []struct {
+		name string
+		b    InstanceConfig
+		want bool
+	}{
+		{"identical", base, true},
+		{"interfaces differ", withInterfaces(base, "eth1"), true},
+		{"ports differ", withPorts(base, 1901), true},
+		{"dest ports differ", withDestPorts(base, 1901), true},
+		{"groups differ", withGroups(base, "224.0.0.251"), true},
+		{"verbose differs", withVerbose(base, true), false},
+		{"ssdp-rewrite differs", withSSDPRewrite(base, true), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := onlyTopologyChanged(base, tt.b); got != tt.want {
+				t.Errorf("onlyTopologyChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func withGroups(c InstanceConfig, groups ...string) InstanceConfig {
+	c.Groups = groups
+	return c
+}
+
+func withInterfaces(c InstanceConfig, ifaces ...string) InstanceConfig {
+	c.Interfaces = ifaces
+	return c
+}
+
+func withPorts(c InstanceConfig, ports ...int) InstanceConfig {
+	c.Ports = ports
+	return c
+}
+
+func withDestPorts(c InstanceConfig, ports ...int) InstanceConfig {
+	c.DestPorts = ports
+	return c
+}
+
+func withVerbose(c InstanceConfig, v bool) InstanceConfig {
+	c.Verbose = v
+	return c
+}
+
+func withSSDPRewrite(c InstanceConfig, v bool) InstanceConfig {
+	c.SSDPRewrite = v
+	return c
+}
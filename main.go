@@ -9,8 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
+	"testing"
 	"time"
 )
 
@@ -28,6 +28,15 @@ var (
 	groupsFlag    = flag.String("g", "", "Comma-separated list of multicast groups (e.g. '239.255.255.250,239.255.255.251')")
 	destPortsFlag = flag.String("d", "", "Comma-separated list of target UDP ports to forward to (optional, e.g. '2021,2022')")
 	verboseFlag   = flag.Bool("v", false, "Enable verbose/debug logging")
+	ssdpRewrite   = flag.Bool("ssdp-rewrite", false, "Rewrite SSDP LOCATION/HOST headers and proxy description-document fetches across subnets")
+	bpfFlag       = flag.Bool("bpf", false, "Attach a kernel BPF filter that drops non-SSDP/mDNS traffic before it reaches userspace")
+	bpfDumpFlag   = flag.Bool("bpf-dump", false, "Print the assembled BPF program for each listen port (requires -bpf)")
+	maxPacketFlag = flag.Int("max-packet", 0, "With -bpf, drop frames larger than this many bytes in-kernel (0 = no cap)")
+	configFlag    = flag.String("config", "", "Path to a YAML file describing one or more forwarder instances (overrides -i/-p/-g/-d); reloaded on SIGHUP")
+	adminFlag     = flag.String("admin", "", "Address for the admin HTTP server, e.g. ':9000' (empty disables it)")
+	rateFlag      = flag.String("rate", "", "Per-egress-(iface,group,port) token-bucket limit as <pps>:<burst> (empty disables)")
+	dedupWindow   = flag.Duration("dedup-window", 250*time.Millisecond, "Suppress re-forwarding an identical (src,payload) datagram seen again within this window (0 disables)")
+	logInterval   = flag.Duration("log-interval", 0, "Log a one-line forwarding summary on this interval (0 disables)")
 )
 
 // firstIPv4Addr returns the first IPv4 address found on the given interface.
@@ -57,6 +66,13 @@ func firstIPv4Addr(ifi *net.Interface) (string, error) {
 
 // Add a --version flag
 func init() {
+	if testing.Testing() {
+		// Under `go test`, the test binary's own flags (-test.v, etc.) are
+		// on os.Args instead of ours; parsing them here would fail before
+		// any test gets to run.
+		return
+	}
+
 	versionFlag := flag.Bool("version", false, "Print the version and exit")
 	flag.Parse()
 
@@ -77,68 +93,104 @@ func main() {
 		log.SetFlags(log.LstdFlags)
 	}
 
-	// Validate mandatory flags
+	cfg, err := buildConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var bpfCfg *bpfConfig
+	if *bpfFlag {
+		bpfCfg = &bpfConfig{maxPacket: *maxPacketFlag, dump: *bpfDumpFlag}
+	}
+
+	rateCfg, err := parseRateFlag(*rateFlag)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	shaping := shapingConfig{rate: rateCfg, dedupWindow: *dedupWindow}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr := NewManager(ctx, bpfCfg, shaping)
+	if err := mgr.ApplyConfig(cfg); err != nil {
+		log.Fatalf("Failed to start forwarders: %v", err)
+	}
+
+	if *adminFlag != "" {
+		startAdminServer(*adminFlag, mgr, *configFlag)
+	}
+
+	if *logInterval > 0 {
+		go logSummaryLoop(mgr, *logInterval)
+	}
+
+	// Handle graceful shutdown
+	handleShutdown(cancel)
+
+	// Re-read --config and apply the diff on SIGHUP
+	if *configFlag != "" {
+		handleReload(*configFlag, mgr)
+	}
+
+	<-ctx.Done()
+	mgr.StopAll()
+
+	log.Println("All done.")
+}
+
+// buildConfig returns the FileConfig to run: the parsed --config document
+// if one was given, or a single synthetic instance named "default" built
+// from the -i/-p/-g/-d flags otherwise.
+func buildConfig() (*FileConfig, error) {
+	if *configFlag != "" {
+		return loadConfig(*configFlag)
+	}
+
 	if *ifacesFlag == "" {
-		log.Fatalf("No interfaces specified. Use -i <iface1,iface2,...>")
+		return nil, fmt.Errorf("no interfaces specified. Use -i <iface1,iface2,...> or -config <file>")
 	}
 	if *portsFlag == "" {
-		log.Fatalf("No ports specified. Use -p <port1,port2,...>")
+		return nil, fmt.Errorf("no ports specified. Use -p <port1,port2,...> or -config <file>")
 	}
 	if *groupsFlag == "" {
-		log.Fatalf("No groups specified. Use -g <group1,group2,...>")
+		return nil, fmt.Errorf("no groups specified. Use -g <group1,group2,...> or -config <file>")
 	}
 
-	// Split and parse the flags
 	ifaceNames := parseCommaSeparated(*ifacesFlag)
 	portStrs := parseCommaSeparated(*portsFlag)
 	groupStrs := parseCommaSeparated(*groupsFlag)
 
-	// Convert port strings to int
 	ports, err := parsePorts(portStrs)
 	if err != nil {
-		log.Fatalf("Error parsing ports: %v", err)
+		return nil, fmt.Errorf("error parsing ports: %w", err)
 	}
 
-	// Trim spaces from group addresses
 	for i, g := range groupStrs {
 		groupStrs[i] = strings.TrimSpace(g)
 	}
 
-	// Handle destination ports (-d)
 	var destPorts []int
 	if *destPortsFlag != "" {
 		destPortStrs := parseCommaSeparated(*destPortsFlag)
 		destPorts, err = parsePorts(destPortStrs)
 		if err != nil {
-			log.Fatalf("Error parsing destination ports: %v", err)
+			return nil, fmt.Errorf("error parsing destination ports: %w", err)
 		}
 		if len(destPorts) != len(ports) {
-			log.Fatalf("Number of destination ports (%d) must match number of listening ports (%d)", len(destPorts), len(ports))
+			return nil, fmt.Errorf("number of destination ports (%d) must match number of listening ports (%d)", len(destPorts), len(ports))
 		}
 	} else {
-		// If -d not set, use the same ports for destination
 		destPorts = ports
 	}
 
-	// Initialize data structures
-	// conns[group][iface][port] and senders[group][iface][port]
-	conns, senders := initializeConnections(groupStrs, ifaceNames, ports, destPorts)
-
-	// Start forwarding goroutines
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	startForwarding(ctx, &wg, conns, senders, groupStrs, ifaceNames, ports, destPorts, *verboseFlag)
-
-	// Handle graceful shutdown
-	handleShutdown(cancel)
-
-	// Wait for all goroutines to finish
-	wg.Wait()
-
-	// Close all sockets
-	closeConnections(conns, senders)
-
-	log.Println("All done.")
+	return &FileConfig{Instances: []InstanceConfig{{
+		ID:          "default",
+		Interfaces:  ifaceNames,
+		Groups:      groupStrs,
+		Ports:       ports,
+		DestPorts:   destPorts,
+		Verbose:     *verboseFlag,
+		SSDPRewrite: *ssdpRewrite,
+	}}}, nil
 }
 
 // parseCommaSeparated splits a comma-separated string into a slice of strings.
@@ -170,149 +222,6 @@ func parsePorts(portStrs []string) ([]int, error) {
 	return ports, nil
 }
 
-// initializeConnections sets up listening and sending UDP connections.
-func initializeConnections(groups, ifaces []string, ports, destPorts []int) ([][][]*net.UDPConn, [][][]*net.UDPConn) {
-	numGroups := len(groups)
-	numIfaces := len(ifaces)
-	numPorts := len(ports)
-
-	conns := make([][][]*net.UDPConn, numGroups)
-	senders := make([][][]*net.UDPConn, numGroups)
-
-	for g := 0; g < numGroups; g++ {
-		conns[g] = make([][]*net.UDPConn, numIfaces)
-		senders[g] = make([][]*net.UDPConn, numIfaces)
-		for i := 0; i < numIfaces; i++ {
-			conns[g][i] = make([]*net.UDPConn, numPorts)
-			senders[g][i] = make([]*net.UDPConn, numPorts)
-		}
-	}
-
-	for g, group := range groups {
-		mcastIP := net.ParseIP(group)
-		if mcastIP == nil {
-			log.Fatalf("Failed to parse multicast group %q", group)
-		}
-
-		for i, ifName := range ifaces {
-			ifi, err := net.InterfaceByName(ifName)
-			if err != nil {
-				log.Fatalf("Could not find interface %q: %v", ifName, err)
-			}
-
-			localIP, err := firstIPv4Addr(ifi)
-			if err != nil {
-				log.Fatalf("Could not determine IPv4 for interface %s: %v", ifName, err)
-			}
-
-			for p, port := range ports {
-				maddr := &net.UDPAddr{
-					IP:   mcastIP,
-					Port: port,
-				}
-
-				// 1) Listen for multicast on (group, port) for this interface
-				lconn, err := net.ListenMulticastUDP("udp4", ifi, maddr)
-				if err != nil {
-					log.Fatalf("Failed to listen on group=%s, port=%d, iface=%s: %v",
-						group, port, ifName, err)
-				}
-
-				// Optionally adjust read buffer size
-				lconn.SetReadBuffer(BufferLen)
-
-				// 2) Create sending connection from (localIP) to (group:destPort)
-				destPort := destPorts[p]
-				destAddr := &net.UDPAddr{
-					IP:   mcastIP,
-					Port: destPort,
-				}
-				localAddr := &net.UDPAddr{IP: net.ParseIP(localIP), Port: 0} // Ephemeral port
-				senderConn, err := net.DialUDP("udp4", localAddr, destAddr)
-				if err != nil {
-					log.Fatalf("Could not create sender on group=%s, iface=%s (%s), port=%d: %v",
-						group, ifName, localIP, destPort, err)
-				}
-
-				conns[g][i][p] = lconn
-				senders[g][i][p] = senderConn
-
-				log.Printf("Joined group=%s on interface=%s:%d, localIP=%s (listening & sending to port %d)",
-					group, ifName, port, localIP, destPort)
-			}
-		}
-	}
-
-	return conns, senders
-}
-
-// startForwarding launches goroutines to handle packet forwarding.
-func startForwarding(ctx context.Context, wg *sync.WaitGroup, conns, senders [][][]*net.UDPConn, groups, ifaces []string, ports, destPorts []int, verbose bool) {
-	for g := range groups {
-		for i := range ifaces {
-			for p := range ports {
-				wg.Add(1)
-				go func(gIdx, iIdx, pIdx int) {
-					defer wg.Done()
-					buf := make([]byte, BufferLen)
-					lconn := conns[gIdx][iIdx][pIdx]
-					group := groups[gIdx]
-					port := ports[pIdx]
-					// destPort := destPorts[pIdx]
-					ifaceName := ifaces[iIdx]
-
-					for {
-						select {
-						case <-ctx.Done():
-							if verbose {
-								log.Printf("Goroutine for group=%s, iface=%s, port=%d exiting.", group, ifaceName, port)
-							}
-							return
-						default:
-							// Set a deadline to allow goroutine to exit on context cancellation
-							lconn.SetReadDeadline(time.Now().Add(1 * time.Second))
-							n, src, err := lconn.ReadFromUDP(buf)
-							if err != nil {
-								// Check if timeout due to deadline
-								if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-									continue // Retry reading
-								}
-								log.Printf("Read error on group=%s, iface=%s, port=%d: %v",
-									group, ifaceName, port, err)
-								return
-							}
-
-							packet := make([]byte, n)
-							copy(packet, buf[:n])
-
-							// Forward to all other interfaces for the same group & port
-							for otherIfIdx := range ifaces {
-								if otherIfIdx == iIdx {
-									continue // Don't send back on the same interface
-								}
-								senderConn := senders[gIdx][otherIfIdx][pIdx]
-								_, werr := senderConn.Write(packet)
-								if werr != nil {
-									log.Printf("Forward error: group=%s, from iface=%s to iface=%s, dest port=%d: %v",
-										group, ifaces[iIdx], ifaces[otherIfIdx], destPorts[pIdx], werr)
-								} else if verbose {
-									log.Printf("Forwarded %d bytes from %s:%d on iface=%s to iface=%s:%d",
-										n, src.IP, src.Port, ifaces[iIdx], ifaces[otherIfIdx], destPorts[pIdx])
-								}
-							}
-
-							if verbose {
-								log.Printf("Received %d bytes from %v on (group=%s, iface=%s, port=%d)",
-									n, src, group, ifaceName, port)
-							}
-						}
-					}
-				}(g, i, p)
-			}
-		}
-	}
-}
-
 // handleShutdown sets up signal handling for graceful shutdown.
 func handleShutdown(cancel context.CancelFunc) {
 	sigChan := make(chan os.Signal, 1)
@@ -325,18 +234,19 @@ func handleShutdown(cancel context.CancelFunc) {
 	}()
 }
 
-// closeConnections gracefully closes all UDP connections.
-func closeConnections(conns, senders [][][]*net.UDPConn) {
-	for g := range conns {
-		for i := range conns[g] {
-			for p := range conns[g][i] {
-				if conns[g][i][p] != nil {
-					conns[g][i][p].Close()
-				}
-				if senders[g][i][p] != nil {
-					senders[g][i][p].Close()
-				}
+// handleReload re-reads configPath and applies the diff to mgr every time
+// the process receives SIGHUP, without dropping in-flight traffic on
+// unchanged instances.
+func handleReload(configPath string, mgr *Manager) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			log.Printf("Received SIGHUP, reloading %s", configPath)
+			if err := reloadFromFile(mgr, configPath); err != nil {
+				log.Printf("Reload failed: %v", err)
 			}
 		}
-	}
-}
\ No newline at end of file
+	}()
+}
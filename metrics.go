@@ -0,0 +1,44 @@
+package main
+
+import "sync/atomic"
+
+// portStats holds the atomically-updated packet/byte counters for a single
+// portGroup, surfaced by the admin server's /state and /metrics endpoints.
+type portStats struct {
+	packetsIn  uint64
+	bytesIn    uint64
+	packetsOut uint64
+	bytesOut   uint64
+
+	rateLimited uint64 // packets dropped by --rate
+	deduped     uint64 // packets dropped as duplicates within the dedup window
+}
+
+func (s *portStats) addIn(n int) {
+	atomic.AddUint64(&s.packetsIn, 1)
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+}
+
+func (s *portStats) addOut(n int) {
+	atomic.AddUint64(&s.packetsOut, 1)
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+}
+
+func (s *portStats) addRateLimited() {
+	atomic.AddUint64(&s.rateLimited, 1)
+}
+
+func (s *portStats) addDeduped() {
+	atomic.AddUint64(&s.deduped, 1)
+}
+
+func (s *portStats) snapshot() portStats {
+	return portStats{
+		packetsIn:   atomic.LoadUint64(&s.packetsIn),
+		bytesIn:     atomic.LoadUint64(&s.bytesIn),
+		packetsOut:  atomic.LoadUint64(&s.packetsOut),
+		bytesOut:    atomic.LoadUint64(&s.bytesOut),
+		rateLimited: atomic.LoadUint64(&s.rateLimited),
+		deduped:     atomic.LoadUint64(&s.deduped),
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitConfig is the parsed form of --rate <pps>:<burst>.
+type rateLimitConfig struct {
+	pps   float64
+	burst float64
+}
+
+// parseRateFlag parses "pps:burst", e.g. "20:40".
+func parseRateFlag(s string) (*rateLimitConfig, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid -rate %q, want <pps>:<burst>", s)
+	}
+	pps, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -rate pps %q: %w", parts[0], err)
+	}
+	burst, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -rate burst %q: %w", parts[1], err)
+	}
+	return &rateLimitConfig{pps: pps, burst: burst}, nil
+}
+
+// tokenBucket is a simple token-bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Allow reports whether a packet may be sent now, consuming one token if so.
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// egressLimiter hands out one token bucket per (egress interface, group,
+// port) tuple, lazily created on first use.
+type egressLimiter struct {
+	cfg rateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newEgressLimiter(cfg rateLimitConfig) *egressLimiter {
+	return &egressLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow reports whether a packet leaving on ifIndex toward group:port may
+// be sent right now.
+func (l *egressLimiter) Allow(ifIndex int, group net.IP, port int) bool {
+	key := fmt.Sprintf("%d|%s|%d", ifIndex, group, port)
+
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.cfg.pps, l.cfg.burst)
+		l.buckets[key] = b
+	}
+	l.mu.Unlock()
+
+	return b.Allow()
+}
+
+// dedupCache suppresses re-forwarding the same datagram seen again within
+// window, keyed by FNV-64 of (source IP, port, first 256 bytes of payload). This
+// catches the common case where overlapping L2 domains deliver the same
+// NOTIFY to the forwarder on more than one joined interface.
+type dedupCache struct {
+	window time.Duration
+	stop   chan struct{}
+
+	mu   sync.Mutex
+	seen map[uint64]time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	d := &dedupCache{window: window, seen: make(map[uint64]time.Time), stop: make(chan struct{})}
+	go d.reapLoop()
+	return d
+}
+
+// Close stops d's reaper goroutine. It is safe to call exactly once; the
+// dedupCache must not be used afterwards.
+func (d *dedupCache) Close() {
+	close(d.stop)
+}
+
+func (d *dedupCache) reapLoop() {
+	ticker := time.NewTicker(10 * d.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.mu.Lock()
+			for h, seenAt := range d.seen {
+				if now.Sub(seenAt) > d.window {
+					delete(d.seen, h)
+				}
+			}
+			d.mu.Unlock()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+const dedupPrefixLen = 256
+
+// Seen reports whether (src, port, payload) was already forwarded within
+// the dedup window, recording it as seen either way.
+func (d *dedupCache) Seen(src net.IP, port int, payload []byte) bool {
+	h := fnv.New64a()
+	h.Write(src)
+	h.Write([]byte{byte(port >> 8), byte(port)})
+	if len(payload) > dedupPrefixLen {
+		payload = payload[:dedupPrefixLen]
+	}
+	h.Write(payload)
+	key := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if last, ok := d.seen[key]; ok && time.Since(last) <= d.window {
+		d.seen[key] = time.Now()
+		return true
+	}
+	d.seen[key] = time.Now()
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRateFlag(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    *rateLimitConfig
+		wantErr bool
+	}{
+		{"empty disables", "", nil, false},
+		{"valid", "20:40", &rateLimitConfig{pps: 20, burst: 40}, false},
+		{"fractional", "0.5:1", &rateLimitConfig{pps: 0.5, burst: 1}, false},
+		{"missing colon", "20", nil, true},
+		{"bad pps", "x:40", nil, true},
+		{"bad burst", "20:x", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRateFlag(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateFlag(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("parseRateFlag(%q) = %+v, want nil", tt.in, got)
+				}
+				return
+			}
+			if got == nil || *got != *tt.want {
+				t.Fatalf("parseRateFlag(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	b := newTokenBucket(10, 2) // 10 tokens/sec, burst of 2
+
+	if !b.Allow() {
+		t.Fatal("first Allow() on a full bucket: want true")
+	}
+	if !b.Allow() {
+		t.Fatal("second Allow() within burst: want true")
+	}
+	if b.Allow() {
+		t.Fatal("third Allow() with burst exhausted: want false")
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(100, 1) // 100 tokens/sec, burst of 1
+	if !b.Allow() {
+		t.Fatal("initial Allow(): want true")
+	}
+	if b.Allow() {
+		t.Fatal("Allow() immediately after exhausting burst: want false")
+	}
+
+	// Backdate "last" so the next Allow() sees enough elapsed time to
+	// refill at least one token, without sleeping in the test.
+	b.mu.Lock()
+	b.last = b.last.Add(-20 * time.Millisecond)
+	b.mu.Unlock()
+
+	if !b.Allow() {
+		t.Fatal("Allow() after simulated refill window: want true")
+	}
+}
+
+func TestEgressLimiterPerTuple(t *testing.T) {
+	l := newEgressLimiter(rateLimitConfig{pps: 10, burst: 1})
+	group := net.ParseIP("239.255.255.250")
+
+	if !l.Allow(1, group, 1900) {
+		t.Fatal("first Allow() for a fresh tuple: want true")
+	}
+	if l.Allow(1, group, 1900) {
+		t.Fatal("second Allow() for the same tuple with burst=1: want false")
+	}
+	if !l.Allow(2, group, 1900) {
+		t.Fatal("Allow() for a different ifIndex: want true (separate bucket)")
+	}
+}
+
+func TestDedupCacheSeen(t *testing.T) {
+	d := &dedupCache{window: time.Minute, seen: make(map[uint64]time.Time)}
+	src := net.ParseIP("192.168.1.5")
+	payload := []byte("NOTIFY * HTTP/1.1\r\n\r\n")
+
+	if d.Seen(src, 1900, payload) {
+		t.Fatal("first Seen() for a fresh (src,port,payload): want false")
+	}
+	if !d.Seen(src, 1900, payload) {
+		t.Fatal("second Seen() within the window: want true (duplicate)")
+	}
+	if d.Seen(src, 1901, payload) {
+		t.Fatal("Seen() with a different port: want false (distinct tuple)")
+	}
+	if d.Seen(net.ParseIP("192.168.1.6"), 1900, payload) {
+		t.Fatal("Seen() with a different source: want false (distinct tuple)")
+	}
+}
+
+func TestDedupCacheExpiresOutsideWindow(t *testing.T) {
+	d := &dedupCache{window: time.Millisecond, seen: make(map[uint64]time.Time)}
+	src := net.ParseIP("192.168.1.5")
+	payload := []byte("NOTIFY * HTTP/1.1\r\n\r\n")
+
+	if d.Seen(src, 1900, payload) {
+		t.Fatal("first Seen(): want false")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if d.Seen(src, 1900, payload) {
+		t.Fatal("Seen() after the dedup window elapsed: want false (not a duplicate)")
+	}
+}
+
+func TestDedupCacheTruncatesLongPayloads(t *testing.T) {
+	d := &dedupCache{window: time.Minute, seen: make(map[uint64]time.Time)}
+	src := net.ParseIP("192.168.1.5")
+
+	long := make([]byte, dedupPrefixLen+100)
+	for i := range long {
+		long[i] = 'a'
+	}
+	longDifferentTail := append([]byte{}, long...)
+	longDifferentTail[len(longDifferentTail)-1] = 'b'
+
+	if d.Seen(src, 1900, long) {
+		t.Fatal("first Seen(): want false")
+	}
+	if !d.Seen(src, 1900, longDifferentTail) {
+		t.Fatal("Seen() with payloads identical in their first dedupPrefixLen bytes: want true (hashed prefix matches)")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSSDPMaxAge  = 1800 * time.Second // used when CACHE-CONTROL is missing or unparsable
+	proxyReapInterval  = 30 * time.Second
+	forwardedByMaxHops = 8 // safety net in case instance IDs collide
+)
+
+// instanceID identifies this forwarder process in the X-Forwarded-By chain
+// header, so a packet that loops back through us (directly, or via another
+// chained forwarder that already saw us) can be detected and dropped.
+var instanceID = fmt.Sprintf("%s-%d", mustHostname(), os.Getpid())
+
+func mustHostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "ssdp-forwarder"
+	}
+	return h
+}
+
+// httpuMessage is a parsed HTTPU (SSDP-over-UDP) request or response: a
+// start line followed by "Key: Value" headers. Header order and casing are
+// preserved so a rewritten message round-trips as close to the original as
+// possible.
+type httpuMessage struct {
+	startLine string
+	headers   [][2]string
+}
+
+// parseHTTPU parses an SSDP datagram payload. It returns ok=false if the
+// payload doesn't look like an HTTPU message (no blank-line-terminated
+// header block), in which case callers should forward it unmodified.
+func parseHTTPU(payload []byte) (msg httpuMessage, ok bool) {
+	text := string(payload)
+	sep := "\r\n\r\n"
+	idx := strings.Index(text, sep)
+	if idx < 0 {
+		return httpuMessage{}, false
+	}
+	lines := strings.Split(text[:idx], "\r\n")
+	if len(lines) == 0 {
+		return httpuMessage{}, false
+	}
+	msg.startLine = lines[0]
+	for _, line := range lines[1:] {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:colon])
+		val := strings.TrimSpace(line[colon+1:])
+		msg.headers = append(msg.headers, [2]string{key, val})
+	}
+	return msg, true
+}
+
+func (m httpuMessage) header(name string) (string, int) {
+	for i, h := range m.headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1], i
+		}
+	}
+	return "", -1
+}
+
+func (m *httpuMessage) setHeader(name, value string) {
+	for i, h := range m.headers {
+		if strings.EqualFold(h[0], name) {
+			m.headers[i][1] = value
+			return
+		}
+	}
+	m.headers = append(m.headers, [2]string{name, value})
+}
+
+// bytes serializes the message back into an HTTPU datagram payload.
+func (m httpuMessage) bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(m.startLine)
+	buf.WriteString("\r\n")
+	for _, h := range m.headers {
+		buf.WriteString(h[0])
+		buf.WriteString(": ")
+		buf.WriteString(h[1])
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// proxiedAddr is a TTL'd reverse-proxy entry: a TCP listener bound on
+// localIP that relays connections back to the real device at target.
+type proxiedAddr struct {
+	target   string // real host:port the description document actually lives at
+	listener net.Listener
+	expires  time.Time
+}
+
+// ssdpRewriter implements --ssdp-rewrite: it rewrites LOCATION/HOST headers
+// in forwarded SSDP packets so cross-subnet clients can resolve them, and
+// spins up lightweight TCP reverse proxies so the resulting URLs are
+// actually reachable.
+type ssdpRewriter struct {
+	mu      sync.Mutex
+	proxies map[string]*proxiedAddr // "localIP:proxyPort" -> entry
+	started bool
+	stop    chan struct{}
+}
+
+func newSSDPRewriter() *ssdpRewriter {
+	r := &ssdpRewriter{proxies: make(map[string]*proxiedAddr), stop: make(chan struct{})}
+	go r.reapLoop()
+	return r
+}
+
+// Close stops r's reaper goroutine and closes every outstanding proxy
+// listener. It is safe to call exactly once; the ssdpRewriter must not be
+// used afterwards.
+func (r *ssdpRewriter) Close() {
+	close(r.stop)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, p := range r.proxies {
+		p.listener.Close()
+		delete(r.proxies, key)
+	}
+}
+
+func (r *ssdpRewriter) reapLoop() {
+	ticker := time.NewTicker(proxyReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			r.mu.Lock()
+			for key, p := range r.proxies {
+				if now.After(p.expires) {
+					p.listener.Close()
+					delete(r.proxies, key)
+				}
+			}
+			r.mu.Unlock()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// proxyFor returns the "host:port" clients on outIf should use to reach
+// target, reusing an existing reverse proxy if one is already running for
+// that (outIf, target) pair, or starting a new one on an ephemeral port.
+func (r *ssdpRewriter) proxyFor(localIP net.IP, target string, maxAge time.Duration) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, p := range r.proxies {
+		if p.target != target {
+			continue
+		}
+		host, _, err := net.SplitHostPort(key)
+		if err != nil || host != localIP.String() {
+			continue
+		}
+		p.expires = time.Now().Add(maxAge)
+		return key, nil
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP, Port: 0})
+	if err != nil {
+		return "", fmt.Errorf("listen for LOCATION proxy to %s on %s: %w", target, localIP, err)
+	}
+	key := ln.Addr().String()
+	r.proxies[key] = &proxiedAddr{target: target, listener: ln, expires: time.Now().Add(maxAge)}
+	go runReverseProxy(ln, target)
+	return key, nil
+}
+
+// runReverseProxy accepts connections on ln and relays bytes to target
+// (the real device's description-document / SCPD / control / event-sub
+// HTTP server) until ln is closed.
+func runReverseProxy(ln net.Listener, target string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // listener closed by the reaper
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.DialTimeout("tcp", target, 5*time.Second)
+			if err != nil {
+				log.Printf("ssdp-rewrite: could not reach %s: %v", target, err)
+				return
+			}
+			defer upstream.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() { defer wg.Done(); io.Copy(upstream, conn) }()
+			go func() { defer wg.Done(); io.Copy(conn, upstream) }()
+			wg.Wait()
+		}()
+	}
+}
+
+// rewrite inspects an outbound SSDP/mDNS packet for interface outIf and, if
+// it parses as an HTTPU message, rewrites its LOCATION/HOST headers and the
+// X-Forwarded-By loop-detection header. It returns the (possibly
+// unmodified) payload to forward, and ok=false if the packet should be
+// dropped (a forwarding loop was detected).
+func (r *ssdpRewriter) rewrite(msg httpuMessage, localIP net.IP, destPort int) ([]byte, bool) {
+	if fwdBy, _ := msg.header("X-Forwarded-By"); fwdBy != "" {
+		hops := strings.Split(fwdBy, ",")
+		if len(hops) >= forwardedByMaxHops {
+			return nil, false
+		}
+		for _, hop := range hops {
+			if strings.TrimSpace(hop) == instanceID {
+				return nil, false // we've already forwarded this packet once; drop the loop
+			}
+		}
+		msg.setHeader("X-Forwarded-By", fwdBy+","+instanceID)
+	} else {
+		msg.setHeader("X-Forwarded-By", instanceID)
+	}
+
+	if loc, _ := msg.header("LOCATION"); loc != "" {
+		if rewritten, err := r.rewriteLocation(loc, localIP, msg); err == nil {
+			msg.setHeader("LOCATION", rewritten)
+		} else {
+			log.Printf("ssdp-rewrite: could not rewrite LOCATION %q: %v", loc, err)
+		}
+	}
+
+	if host, idx := msg.header("HOST"); idx >= 0 {
+		if hostIP, _, err := net.SplitHostPort(host); err == nil {
+			msg.headers[idx][1] = net.JoinHostPort(hostIP, strconv.Itoa(destPort))
+		}
+	}
+
+	return msg.bytes(), true
+}
+
+// rewriteLocation replaces the host:port of an HTTP LOCATION URL with a
+// reverse-proxy address on localIP, keeping the path untouched so the SCPD
+// / control / event-sub URLs embedded in the fetched description document
+// resolve through the same proxy.
+func (r *ssdpRewriter) rewriteLocation(loc string, localIP net.IP, msg httpuMessage) (string, error) {
+	rest, ok := strings.CutPrefix(loc, "http://")
+	if !ok {
+		return "", fmt.Errorf("unsupported LOCATION scheme: %q", loc)
+	}
+	slash := strings.Index(rest, "/")
+	hostport := rest
+	path := "/"
+	if slash >= 0 {
+		hostport = rest[:slash]
+		path = rest[slash:]
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = hostport + ":80"
+	}
+
+	proxyAddr, err := r.proxyFor(localIP, hostport, ssdpMaxAge(msg))
+	if err != nil {
+		return "", err
+	}
+	return "http://" + proxyAddr + path, nil
+}
+
+// applySSDPRewrite is the packet-inspection hook called from the
+// forwarding goroutines before each outbound write. With --ssdp-rewrite
+// disabled (rewriter == nil) it's a no-op that forwards the packet as-is.
+func applySSDPRewrite(rewriter *ssdpRewriter, packet []byte, localIP net.IP, destPort int) ([]byte, bool) {
+	if rewriter == nil {
+		return packet, true
+	}
+	msg, ok := parseHTTPU(packet)
+	if !ok {
+		return packet, true // not an HTTPU message (e.g. mDNS/DNS binary payload) - pass through
+	}
+	if localIP == nil {
+		return packet, true // outbound interface has no address of this family to proxy from
+	}
+	return rewriter.rewrite(msg, localIP, destPort)
+}
+
+// ssdpMaxAge extracts the max-age value from a CACHE-CONTROL header
+// (e.g. "max-age=1800"), falling back to defaultSSDPMaxAge.
+func ssdpMaxAge(msg httpuMessage) time.Duration {
+	cc, _ := msg.header("CACHE-CONTROL")
+	for _, field := range strings.Split(cc, ";") {
+		field = strings.TrimSpace(field)
+		if v, ok := strings.CutPrefix(field, "max-age="); ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return defaultSSDPMaxAge
+}
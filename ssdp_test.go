@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseHTTPU(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantOK  bool
+		start   string
+		headers map[string]string
+	}{
+		{
+			name: "notify",
+			payload: "NOTIFY * HTTP/1.1\r\n" +
+				"HOST: 239.255.255.250:1900\r\n" +
+				"LOCATION: http://192.168.1.5:8080/desc.xml\r\n" +
+				"CACHE-CONTROL: max-age=1800\r\n" +
+				"\r\n",
+			wantOK: true,
+			start:  "NOTIFY * HTTP/1.1",
+			headers: map[string]string{
+				"HOST":          "239.255.255.250:1900",
+				"LOCATION":      "http://192.168.1.5:8080/desc.xml",
+				"CACHE-CONTROL": "max-age=1800",
+			},
+		},
+		{
+			name:    "no header terminator",
+			payload: "NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n",
+			wantOK:  false,
+		},
+		{
+			name:    "binary mdns payload",
+			payload: "\x00\x00\x84\x00\x00\x00\x00\x01\x00\x00\x00\x00",
+			wantOK:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, ok := parseHTTPU([]byte(tt.payload))
+			if ok != tt.wantOK {
+				t.Fatalf("parseHTTPU() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+			if msg.startLine != tt.start {
+				t.Errorf("startLine = %q, want %q", msg.startLine, tt.start)
+			}
+			for name, want := range tt.headers {
+				got, idx := msg.header(name)
+				if idx < 0 {
+					t.Errorf("header %q missing", name)
+					continue
+				}
+				if got != want {
+					t.Errorf("header %q = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	r := newSSDPRewriter()
+	localIP := net.ParseIP("127.0.0.1")
+	msg, ok := parseHTTPU([]byte("NOTIFY * HTTP/1.1\r\nCACHE-CONTROL: max-age=60\r\n\r\n"))
+	if !ok {
+		t.Fatal("parseHTTPU failed to parse fixture message")
+	}
+
+	rewritten, err := r.rewriteLocation("http://192.168.1.5:8080/device/desc.xml", localIP, msg)
+	if err != nil {
+		t.Fatalf("rewriteLocation() error = %v", err)
+	}
+	if want, got := "http://"+localIP.String(), rewritten[:len("http://")+len(localIP.String())]; got != want {
+		t.Errorf("rewriteLocation() = %q, want host prefix %q", rewritten, want)
+	}
+	if !hasSuffix(rewritten, "/device/desc.xml") {
+		t.Errorf("rewriteLocation() = %q, want path /device/desc.xml preserved", rewritten)
+	}
+
+	// A second rewrite to the same target on the same localIP must reuse
+	// the existing proxy entry rather than opening a new listener.
+	again, err := r.rewriteLocation("http://192.168.1.5:8080/device/desc.xml", localIP, msg)
+	if err != nil {
+		t.Fatalf("rewriteLocation() second call error = %v", err)
+	}
+	if again != rewritten {
+		t.Errorf("rewriteLocation() did not reuse proxy: first=%q second=%q", rewritten, again)
+	}
+
+	if _, err := r.rewriteLocation("https://192.168.1.5/desc.xml", localIP, msg); err == nil {
+		t.Error("rewriteLocation() with https:// scheme: want error, got nil")
+	}
+}
+
+func TestRewriteLocationIPv6ReusesProxy(t *testing.T) {
+	r := newSSDPRewriter()
+	localIP := net.ParseIP("::1")
+	msg, _ := parseHTTPU([]byte("NOTIFY * HTTP/1.1\r\n\r\n"))
+
+	first, err := r.rewriteLocation("http://[fe80::2]:8080/desc.xml", localIP, msg)
+	if err != nil {
+		t.Fatalf("rewriteLocation() error = %v", err)
+	}
+
+	r.mu.Lock()
+	n := len(r.proxies)
+	r.mu.Unlock()
+
+	second, err := r.rewriteLocation("http://[fe80::2]:8080/desc.xml", localIP, msg)
+	if err != nil {
+		t.Fatalf("rewriteLocation() second call error = %v", err)
+	}
+	if second != first {
+		t.Errorf("rewriteLocation() on IPv6 localIP did not reuse proxy: first=%q second=%q", first, second)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.proxies) != n {
+		t.Errorf("proxy count grew from %d to %d on repeated IPv6 rewrite, want no new listener", n, len(r.proxies))
+	}
+}
+
+func hasSuffix(s, suffix string) bool {
+	return len(s) >= len(suffix) && s[len(s)-len(suffix):] == suffix
+}
+
+func TestSSDPMaxAge(t *testing.T) {
+	tests := []struct {
+		name string
+		cc   string
+		want time.Duration
+	}{
+		{"explicit", "max-age=60", 60 * time.Second},
+		{"with other directives", "public;max-age=120", 120 * time.Second},
+		{"missing", "", defaultSSDPMaxAge},
+		{"unparsable", "max-age=soon", defaultSSDPMaxAge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := httpuMessage{}
+			if tt.cc != "" {
+				msg.setHeader("CACHE-CONTROL", tt.cc)
+			}
+			if got := ssdpMaxAge(msg); got != tt.want {
+				t.Errorf("ssdpMaxAge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}